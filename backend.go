@@ -0,0 +1,280 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// backendFlag selects which Backend watch() uses to receive filesystem
+// events. fsnotify is the default; poll exists for network filesystems
+// (NFS, SMB, virtiofs) and containers where inotify watch limits
+// (fs.inotify.max_user_watches) are exhausted or events simply aren't
+// delivered. The poll backend can only detect content and existence
+// changes (see pollUnsupportedOps): -events=chmod or -events=rename
+// will never fire the command under -backend=poll.
+var backendFlag = flag.String("backend", "fsnotify", "backend to use for watching the filesystem: fsnotify or poll. poll can't detect chmod or rename events")
+
+// defaultPollInterval is how often pollBackend re-checks watched
+// directories when no more specific interval is requested.
+const defaultPollInterval = 1 * time.Second
+
+// pollUnsupportedOps are the fsnotify.Op bits pollBackend can never
+// synthesize, because neither corresponds to an observable mtime/size
+// change: a rename looks identical to a remove plus a create under
+// polling, and a chmod touches neither mtime nor size at all.
+const pollUnsupportedOps = fsnotify.Chmod | fsnotify.Rename
+
+// Backend is the set of operations watch needs from a filesystem
+// watcher. fsnotifyBackend wraps *fsnotify.Watcher directly; pollBackend
+// polls mtimes and sizes on an interval for filesystems where inotify
+// doesn't work or isn't available.
+type Backend interface {
+	Add(path string) error
+	Remove(path string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+// newBackend creates the Backend named by name. If name is "fsnotify"
+// (the default) and fsnotify.NewWatcher fails with a "too many open
+// files" or "no space left on device" error - e.g. once
+// fs.inotify.max_user_instances is exhausted - it automatically falls
+// back to the poll backend instead of failing outright. Only watcher
+// creation falls back: an Add that fails later, e.g. once
+// fs.inotify.max_user_watches is exhausted, is not retried on the poll
+// backend, and watch() returns its error.
+func newBackend(name string) (Backend, error) {
+	switch name {
+	case "", "fsnotify":
+		b, err := newFsnotifyBackend()
+		if err != nil {
+			if strings.Contains(err.Error(), "too many") || strings.Contains(err.Error(), "no space left") {
+				log.Printf("fsnotify: %s; falling back to -backend=poll", err)
+				return newPollBackend(defaultPollInterval), nil
+			}
+			return nil, err
+		}
+		return b, nil
+	case "poll":
+		return newPollBackend(defaultPollInterval), nil
+	default:
+		return nil, fmt.Errorf("unknown -backend %q: want fsnotify or poll", name)
+	}
+}
+
+// fsnotifyBackend is a thin Backend adapter over *fsnotify.Watcher.
+type fsnotifyBackend struct {
+	w *fsnotify.Watcher
+}
+
+func newFsnotifyBackend() (*fsnotifyBackend, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &fsnotifyBackend{w: w}, nil
+}
+
+func (b *fsnotifyBackend) Add(path string) error         { return b.w.Add(path) }
+func (b *fsnotifyBackend) Remove(path string) error      { return b.w.Remove(path) }
+func (b *fsnotifyBackend) Events() <-chan fsnotify.Event { return b.w.Events }
+func (b *fsnotifyBackend) Errors() <-chan error          { return b.w.Errors }
+func (b *fsnotifyBackend) Close() error                  { return b.w.Close() }
+
+// pollState is the last-seen mtime and size for a polled path.
+type pollState struct {
+	modTime time.Time
+	size    int64
+}
+
+// pollBackend implements Backend by polling the mtime and size of every
+// watched directory's immediate children (and of watched files
+// directly) on interval, synthesizing fsnotify.Event values for
+// anything that's new, changed, or gone. It mirrors fsnotify's
+// single-level watch semantics, so watch()'s own recursive walk works
+// unchanged regardless of which backend is selected.
+type pollBackend struct {
+	interval time.Duration
+	mu       sync.Mutex
+	watched  map[string]bool
+	state    map[string]pollState
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan struct{}
+}
+
+func newPollBackend(interval time.Duration) *pollBackend {
+	b := &pollBackend{
+		interval: interval,
+		watched:  make(map[string]bool),
+		state:    make(map[string]pollState),
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+	}
+	go b.loop()
+	return b
+}
+
+func (b *pollBackend) Add(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.watched[path] = true
+	b.seedLocked(path)
+	return nil
+}
+
+func (b *pollBackend) Remove(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.watched, path)
+	delete(b.state, path)
+	return nil
+}
+
+func (b *pollBackend) Events() <-chan fsnotify.Event { return b.events }
+func (b *pollBackend) Errors() <-chan error          { return b.errors }
+
+func (b *pollBackend) Close() error {
+	close(b.done)
+	return nil
+}
+
+func (b *pollBackend) loop() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.poll()
+		}
+	}
+}
+
+// poll scans every watched path for changes and pushes the resulting
+// events out after releasing b.mu, so a slow or not-yet-started
+// Events() reader can never deadlock a call to Add (see seedLocked).
+// Each send still blocks until it is read, so the next tick waits until
+// the reader has taken every event from this one.
+func (b *pollBackend) poll() {
+	b.mu.Lock()
+	dirs := make([]string, 0, len(b.watched))
+	for dir := range b.watched {
+		dirs = append(dirs, dir)
+	}
+	var events []fsnotify.Event
+	var errs []error
+	for _, dir := range dirs {
+		evs, err := b.scanLocked(dir)
+		events = append(events, evs...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, ev := range events {
+		b.emit(ev)
+	}
+	for _, err := range errs {
+		select {
+		case b.errors <- err:
+		case <-b.done:
+		}
+	}
+}
+
+// seedLocked records the current mtime/size of path's direct children
+// (or of path itself, if it's a file) without emitting any events. It's
+// used by Add so that watching a directory that already has files in
+// it doesn't report every one of them as a new Create on the next poll.
+// The caller must hold b.mu.
+func (b *pollBackend) seedLocked(path string) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if info, statErr := os.Stat(path); statErr == nil && !info.IsDir() {
+			b.state[path] = pollState{modTime: info.ModTime(), size: info.Size()}
+		}
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		childPath := filepath.Join(path, entry.Name())
+		b.state[childPath] = pollState{modTime: info.ModTime(), size: info.Size()}
+	}
+}
+
+// scanLocked compares the current mtime/size of path's direct children
+// (or of path itself, if it's a file) against the last-seen state and
+// returns an event for anything new, changed, or removed. A watched
+// path that no longer exists is returned as an error, not an event; its
+// Remove is reported only by the scan of a watched parent directory. It
+// never sends on b.events itself, so it's safe to call while holding b.mu.
+// The caller must hold b.mu.
+func (b *pollBackend) scanLocked(path string) ([]fsnotify.Event, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if info, statErr := os.Stat(path); statErr == nil && !info.IsDir() {
+			if ev, changed := b.checkLocked(path, info); changed {
+				return []fsnotify.Event{ev}, nil
+			}
+			return nil, nil
+		}
+		return nil, err
+	}
+	var events []fsnotify.Event
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		childPath := filepath.Join(path, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		seen[childPath] = true
+		if ev, changed := b.checkLocked(childPath, info); changed {
+			events = append(events, ev)
+		}
+	}
+	for p := range b.state {
+		if filepath.Dir(p) != path || seen[p] {
+			continue
+		}
+		delete(b.state, p)
+		events = append(events, fsnotify.Event{Name: p, Op: fsnotify.Remove})
+	}
+	return events, nil
+}
+
+func (b *pollBackend) checkLocked(path string, info os.FileInfo) (fsnotify.Event, bool) {
+	next := pollState{modTime: info.ModTime(), size: info.Size()}
+	prev, found := b.state[path]
+	b.state[path] = next
+	switch {
+	case !found:
+		return fsnotify.Event{Name: path, Op: fsnotify.Create}, true
+	case prev.modTime != next.modTime || prev.size != next.size:
+		return fsnotify.Event{Name: path, Op: fsnotify.Write}, true
+	}
+	return fsnotify.Event{}, false
+}
+
+func (b *pollBackend) emit(ev fsnotify.Event) {
+	select {
+	case b.events <- ev:
+	case <-b.done:
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// delayFlag is the coalescing window: after the first event in a burst,
+// justrun waits this long for the burst to go quiet before running the
+// command. Editors like vim and IntelliJ produce rename-write-rename
+// storms on every save, and without this a command would fire once per
+// event in the storm. 300ms mirrors the default Syncthing uses for its
+// own FSWatcherDelayS setting.
+var delayFlag = flag.Duration("delay", 300*time.Millisecond, "how long to wait for a burst of events to go quiet before running the command")
+
+// maxDelayMultiplier bounds how long a steady stream of events can
+// postpone the command. Without a cap, a build tool that keeps touching
+// files every few hundred milliseconds would mean the debounced command
+// never runs at all.
+const maxDelayMultiplier = 10
+
+// coalesceEvents reads individual filesystem events off raw and, after
+// waiting for delay with no further activity (or maxDelayMultiplier*delay
+// of continuous activity, whichever comes first), emits a single event
+// on cmdCh describing every path that changed during the window. It
+// closes cmdCh once raw is closed and drained.
+func coalesceEvents(raw <-chan event, cmdCh chan<- event, delay time.Duration) {
+	var buf []fsnotify.Event
+	var quietTimer, maxTimer *time.Timer
+
+	stop := func(t *time.Timer) {
+		if t != nil {
+			t.Stop()
+		}
+	}
+
+	flush := func() {
+		if len(buf) == 0 {
+			return
+		}
+		cmdCh <- event{
+			Time:   time.Now(),
+			Event:  buf[len(buf)-1],
+			Events: buf,
+		}
+		buf = nil
+		stop(quietTimer)
+		stop(maxTimer)
+		quietTimer, maxTimer = nil, nil
+	}
+
+	for {
+		var quietC, maxC <-chan time.Time
+		if quietTimer != nil {
+			quietC = quietTimer.C
+		}
+		if maxTimer != nil {
+			maxC = maxTimer.C
+		}
+		select {
+		case ev, ok := <-raw:
+			if !ok {
+				flush()
+				close(cmdCh)
+				return
+			}
+			buf = append(buf, ev.Event)
+			stop(quietTimer)
+			quietTimer = time.NewTimer(delay)
+			if maxTimer == nil {
+				maxTimer = time.NewTimer(maxDelayMultiplier * delay)
+			}
+		case <-quietC:
+			flush()
+		case <-maxC:
+			flush()
+		}
+	}
+}
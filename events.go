@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// eventsFlag selects which fsnotify operation types trigger the command.
+// This mirrors the WithEvents filter proposed upstream in fsnotify, and
+// is how you say things like "-events=write" to re-run only on Write
+// and ignore the Chmod noise go build leaves behind when it touches a
+// binary's mode bits, or "-events=create,remove" for a harness that
+// only cares about files appearing and disappearing.
+var eventsFlag = flag.String("events", "create,write,remove,rename,chmod", "comma separated list of event types that trigger the command: create, write, remove, rename, chmod")
+
+// parseEventMask turns a comma separated list of event names into the
+// fsnotify.Op bitmask listenForEvents filters incoming events against.
+func parseEventMask(s string) (fsnotify.Op, error) {
+	var mask fsnotify.Op
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		switch name {
+		case "create":
+			mask |= fsnotify.Create
+		case "write":
+			mask |= fsnotify.Write
+		case "remove":
+			mask |= fsnotify.Remove
+		case "rename":
+			mask |= fsnotify.Rename
+		case "chmod":
+			mask |= fsnotify.Chmod
+		default:
+			return 0, fmt.Errorf("unknown -events type %q: want create, write, remove, rename or chmod", name)
+		}
+	}
+	return mask, nil
+}
+
+// opNames renders mask back into the -events vocabulary, comma
+// separated, for diagnostic messages.
+func opNames(mask fsnotify.Op) string {
+	var names []string
+	for _, o := range []struct {
+		op   fsnotify.Op
+		name string
+	}{
+		{fsnotify.Create, "create"},
+		{fsnotify.Write, "write"},
+		{fsnotify.Remove, "remove"},
+		{fsnotify.Rename, "rename"},
+		{fsnotify.Chmod, "chmod"},
+	} {
+		if mask&o.op != 0 {
+			names = append(names, o.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
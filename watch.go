@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -17,6 +19,197 @@ import (
 
 const maxHashedFileSize = 20 * 1024 * 1024
 
+// recursiveSuffix marks an input path for recursive descent into its
+// subdirectories, e.g. "src/...". This mirrors the "path/..." recursion
+// syntax being proposed upstream in fsnotify itself.
+const recursiveSuffix = "/..."
+
+// isRecursivePath reports whether path requests recursive watching and
+// returns the directory to walk if so.
+func isRecursivePath(path string) (string, bool) {
+	if strings.HasSuffix(path, recursiveSuffix) {
+		return strings.TrimSuffix(path, recursiveSuffix), true
+	}
+	return path, false
+}
+
+// isGlob reports whether path contains glob metacharacters and should be
+// matched against discovered files and directories rather than watched
+// directly.
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// matchGlob reports whether name matches a gitignore-style glob pattern.
+// "**" matches any number of path segments, including none; the other
+// segments are matched with filepath.Match.
+func matchGlob(pattern, name string) bool {
+	return matchGlobParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobParts(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		if matchGlobParts(pattern[1:], name) {
+			return true
+		}
+		if len(name) == 0 {
+			return false
+		}
+		return matchGlobParts(pattern, name[1:])
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, err := filepath.Match(pattern[0], name[0])
+	if err != nil || !ok {
+		return false
+	}
+	return matchGlobParts(pattern[1:], name[1:])
+}
+
+// relTo returns path relative to root, for matching against
+// gitignore-style glob patterns written relative to the directory
+// justrun was started in (e.g. "src/*.go", "cmd/**/testdata"). It falls
+// back to path itself if it can't be made relative, e.g. because it's
+// on a different volume or outside root.
+func relTo(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return rel
+}
+
+// matchAnyGlob reports whether fullPath (made relative to root) matches
+// one of patterns. A pattern with no slash is also matched against the
+// base name, so "node_modules/" ignores any directory named
+// node_modules anywhere in the tree, not just at the watch root;
+// multi-segment patterns like "src/*.go" are anchored to root the way a
+// user typing that pattern at the command line would expect.
+func matchAnyGlob(patterns []string, root, fullPath string) bool {
+	rel := relTo(root, fullPath)
+	base := filepath.Base(fullPath)
+	for _, p := range patterns {
+		p = strings.TrimSuffix(p, "/")
+		if matchGlob(p, rel) {
+			return true
+		}
+		if !strings.Contains(p, "/") && matchGlob(p, base) {
+			return true
+		}
+	}
+	return false
+}
+
+// globRoot returns the literal directory prefix of pattern, up to the
+// first path segment containing a glob metacharacter, so matching an
+// input glob can start the walk as deep as possible instead of always
+// walking from cwd. A pattern with no literal prefix (e.g. "**/*.go")
+// walks from ".".
+func globRoot(pattern string) string {
+	var fixed []string
+	for _, seg := range strings.Split(pattern, "/") {
+		if isGlob(seg) {
+			break
+		}
+		fixed = append(fixed, seg)
+	}
+	if len(fixed) == 0 {
+		return "."
+	}
+	return strings.Join(fixed, "/")
+}
+
+// splitGlobs separates plain filesystem paths from gitignore-style glob
+// patterns, so callers can handle literal paths and patterns separately.
+// A path with a trailing slash (e.g. "node_modules/") counts as a
+// pattern too, so it matches that directory anywhere in the tree.
+func splitGlobs(paths []string) (plain, globs []string) {
+	for _, p := range paths {
+		if isGlob(p) || strings.HasSuffix(p, "/") {
+			globs = append(globs, p)
+		} else {
+			plain = append(plain, p)
+		}
+	}
+	return plain, globs
+}
+
+// walkAndWatch walks the tree rooted at root, adding every subdirectory
+// not matched by ui or ignoreGlobs to w, and recording a digest for
+// every watched file. glob patterns in ignoreGlobs are matched relative
+// to cwd. It is used both for "dir/..." input paths (from the watch()
+// goroutine, at startup) and for directories that show up later via a
+// Create event (from the listenForEvents goroutine) - hence digests
+// going through the mutex-guarded digestStore rather than a plain map.
+func walkAndWatch(w Backend, root string, ui *userIgnorer, ignoreGlobs []string, cwd string, store *digestStore) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ui.IsIgnored(path) || matchAnyGlob(ignoreGlobs, cwd, path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if err := w.Add(path); err != nil {
+				return fmt.Errorf("unable to watch '%s': %s", path, err)
+			}
+			return nil
+		}
+		d, _ := digest(path)
+		store.set(path, d)
+		return nil
+	})
+}
+
+// digestStore is a mutex-guarded map from absolute file path to its
+// last-seen content digest. watch() populates it while resolving the
+// input paths and hands a snapshot back to its caller, but the
+// listenForEvents goroutine it starts keeps mutating the same store
+// afterwards (both directly, in the digest gate, and indirectly via
+// walkAndWatch on dynamic Creates), so every access has to go through
+// the mutex rather than a bare map.
+type digestStore struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func newDigestStore() *digestStore {
+	return &digestStore{m: make(map[string][]byte)}
+}
+
+func (s *digestStore) set(path string, d []byte) {
+	s.mu.Lock()
+	s.m[path] = d
+	s.mu.Unlock()
+}
+
+func (s *digestStore) get(path string) ([]byte, bool) {
+	s.mu.Lock()
+	d, ok := s.m[path]
+	s.mu.Unlock()
+	return d, ok
+}
+
+// snapshot returns a point-in-time copy of the store's contents, safe
+// for a caller to read without racing the goroutines that keep writing
+// to the store itself.
+func (s *digestStore) snapshot() map[string][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string][]byte, len(s.m))
+	for k, v := range s.m {
+		out[k] = v
+	}
+	return out
+}
+
 func digest(path string) ([]byte, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -52,23 +245,99 @@ func watch(inputPaths, ignoredPaths []string, cmdCh chan<- event) (map[string][]
 		return nil, err
 	}
 
-	w, err := fsnotify.NewWatcher()
+	eventMask, err := parseEventMask(*eventsFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := newBackend(*backendFlag)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create watcher: %s", err)
 	}
 
+	if _, isPoll := w.(*pollBackend); isPoll {
+		if unsupported := eventMask & pollUnsupportedOps; unsupported != 0 {
+			log.Printf("warning: -backend=poll can't detect %s events; -events=%s will never trigger the command for them", opNames(unsupported), *eventsFlag)
+		}
+	}
+
+	// cwd anchors multi-segment ignore glob patterns (e.g. "src/*.go")
+	// to the directory justrun was started in, the way a user typing
+	// that pattern at the command line would expect.
+	cwd, err := os.Getwd()
+	if err != nil {
+		w.Close()
+		return nil, errors.New("unable to get current working directory while working with ignore glob patterns")
+	}
+
+	// ignoredPaths may contain gitignore-style glob patterns (e.g.
+	// "**/*.go", "node_modules/") in addition to plain paths; split
+	// those out so they can be matched against every path discovered
+	// while walking, not just the paths the user typed literally.
+	_, ignoreGlobs := splitGlobs(ignoredPaths)
+
 	// Watch user-specified paths and create a set of them for walking
 	// later. Paths that are both asked to be watched and ignored by
 	// the user are ignored.
-	userPaths := make(map[string][]byte)
+	store := newDigestStore()
 	includedHiddenFiles := make(map[string]bool)
 	for _, path := range inputPaths {
+		if dir, recursive := isRecursivePath(path); recursive {
+			fullDir, err := filepath.Abs(dir)
+			if err != nil {
+				w.Close()
+				return nil, errors.New("unable to get current working directory while working with user-watched paths")
+			}
+			if err := walkAndWatch(w, fullDir, ui, ignoreGlobs, cwd, store); err != nil {
+				w.Close()
+				return nil, err
+			}
+			continue
+		}
+		if isGlob(path) {
+			// filepath.Glob doesn't understand "**" (it collapses to a
+			// single path segment), so walk the pattern's literal root
+			// and match every file against it with the same **-aware
+			// matchGlob used for ignoredPaths, keeping the two
+			// gitignore-style glob surfaces consistent.
+			fullRoot, err := filepath.Abs(globRoot(path))
+			if err != nil {
+				w.Close()
+				return nil, errors.New("unable to get current working directory while working with user-watched paths")
+			}
+			walkErr := filepath.Walk(fullRoot, func(fullPath string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() {
+					return nil
+				}
+				if !matchGlob(path, relTo(cwd, fullPath)) {
+					return nil
+				}
+				_, found := store.get(fullPath)
+				if found || ui.IsIgnored(fullPath) || matchAnyGlob(ignoreGlobs, cwd, fullPath) {
+					return nil
+				}
+				if err := w.Add(fullPath); err != nil {
+					return fmt.Errorf("unable to watch '%s': %s", fullPath, err)
+				}
+				d, _ := digest(fullPath)
+				store.set(fullPath, d)
+				return nil
+			})
+			if walkErr != nil {
+				w.Close()
+				return nil, fmt.Errorf("invalid glob pattern '%s': %s", path, walkErr)
+			}
+			continue
+		}
 		fullPath, err := filepath.Abs(path)
 		if err != nil {
 			w.Close()
 			return nil, errors.New("unable to get current working directory while working with user-watched paths")
 		}
-		_, found := userPaths[fullPath]
+		_, found := store.get(fullPath)
 		if found || ui.IsIgnored(path) {
 			continue
 		}
@@ -78,7 +347,7 @@ func watch(inputPaths, ignoredPaths []string, cmdCh chan<- event) (map[string][]
 			return nil, fmt.Errorf("unable to watch '%s': %s", path, err)
 		}
 		d, _ := digest(fullPath)
-		userPaths[fullPath] = d
+		store.set(fullPath, d)
 	}
 
 	// Create some useful sets from the user-specified paths to be
@@ -99,14 +368,15 @@ func watch(inputPaths, ignoredPaths []string, cmdCh chan<- event) (map[string][]
 	// in that parent directory.
 	renameDirs := make(map[string]bool)
 	renameChildren := make(map[string]bool)
-	for fullPath, _ := range userPaths {
+	startupPaths := store.snapshot()
+	for fullPath := range startupPaths {
 		baseName := filepath.Base(fullPath)
 		if strings.HasPrefix(baseName, ".") {
 			includedHiddenFiles[fullPath] = true
 		}
 
 		dirPath := filepath.Dir(fullPath)
-		_, foundDir := userPaths[dirPath]
+		_, foundDir := startupPaths[dirPath]
 		if !foundDir && dirPath != "" {
 			if !renameDirs[dirPath] {
 				err = w.Add(dirPath)
@@ -126,25 +396,71 @@ func watch(inputPaths, ignoredPaths []string, cmdCh chan<- event) (map[string][]
 		renameChildren:      renameChildren,
 	}
 
-	go listenForEvents(w, cmdCh, ig)
-	return userPaths, nil
+	raw := make(chan event)
+	go listenForEvents(w, raw, ig, ui, ignoreGlobs, cwd, store, eventMask)
+	go coalesceEvents(raw, cmdCh, *delayFlag)
+	return store.snapshot(), nil
 }
 
 type event struct {
 	time.Time
 	Event fsnotify.Event
+
+	// Events holds every raw filesystem event coalesced into this one
+	// by coalesceEvents. Event is always Events[len(Events)-1]; callers
+	// that only care about "something changed" can keep using Event
+	// and ignore this field.
+	Events []fsnotify.Event
 }
 
-func listenForEvents(w *fsnotify.Watcher, cmdCh chan<- event, ignorer Ignorer) {
+// listenForEvents reads events off w and forwards the ones the ignorer
+// doesn't filter out to cmdCh. ui, ignoreGlobs and store are the same
+// values watch built at startup; when a new subdirectory shows up under
+// a "dir/..." tree, listenForEvents walks it with the same rules so the
+// watch set keeps growing with the directory tree. eventMask is the
+// -events mask: it only gates whether an event is forwarded to cmdCh,
+// so a Chmod-only subtree still gets its new directories watched even
+// if the user asked to only run the command on Write.
+func listenForEvents(w Backend, cmdCh chan<- event, ignorer Ignorer, ui *userIgnorer, ignoreGlobs []string, cwd string, store *digestStore, eventMask fsnotify.Op) {
 	for {
 		select {
-		case ev, ok := <-w.Events:
+		case ev, ok := <-w.Events():
 			if !ok {
+				close(cmdCh)
 				return
 			}
 			if ignorer.IsIgnored(ev.Name) {
 				continue
 			}
+			if ev.Op&fsnotify.Create == fsnotify.Create {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					if !ui.IsIgnored(ev.Name) && !matchAnyGlob(ignoreGlobs, cwd, ev.Name) {
+						if err := walkAndWatch(w, ev.Name, ui, ignoreGlobs, cwd, store); err != nil {
+							log.Println("watch error:", err)
+						}
+					}
+				}
+			}
+			if ev.Op&eventMask == 0 {
+				continue
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				// digest returns a nil hash (with no error) for
+				// directories and for files over maxHashedFileSize; we
+				// can't compare those, so only gate on an actual hash.
+				// Chmod is deliberately left out of this gate: it never
+				// changes file content, so gating it would make
+				// -events=chmod (see events.go) fire the command for
+				// nothing, ever. Users who want the Chmod-on-delete
+				// noise fsnotify emits on Linux suppressed can drop
+				// chmod from -events instead.
+				if d, err := digest(ev.Name); err == nil && d != nil {
+					if old, found := store.get(ev.Name); found && bytes.Equal(old, d) {
+						continue
+					}
+					store.set(ev.Name, d)
+				}
+			}
 			if *verbose {
 				log.Printf("unignored file change: %s", ev)
 			}
@@ -152,7 +468,7 @@ func listenForEvents(w *fsnotify.Watcher, cmdCh chan<- event, ignorer Ignorer) {
 				Time:  time.Now(),
 				Event: ev,
 			}
-		case err, ok := <-w.Errors:
+		case err, ok := <-w.Errors():
 			if !ok {
 				close(cmdCh)
 				return